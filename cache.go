@@ -0,0 +1,229 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/miekg/dns"
+)
+
+// Badger key prefixes distinguishing the reverse (PTR) cache from the
+// forward response cache sharing the same -store database.
+const (
+	ptrKeyPrefix = "ptr:"
+	fwdKeyPrefix = "fwd:"
+)
+
+// cacheKey identifies one cached forward-lookup entry. subnet is empty
+// unless ECS requires segmenting the cache by the client subnet that was
+// forwarded upstream (see handler.ecsSubnetKey), since the same
+// qname/qtype/qclass can otherwise get a different, subnet-specific
+// answer for different clients.
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	subnet string
+}
+
+func cacheKeyFor(q dns.Question, subnet string) cacheKey {
+	return cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass, subnet: subnet}
+}
+
+func (k cacheKey) encode() string {
+	return fmt.Sprintf("%s|%d|%d|%s", k.name, k.qtype, k.qclass, k.subnet)
+}
+
+// cacheEntry is what's stored for a cacheKey: the wire-format response as
+// it was received, plus the bookkeeping needed to decrement TTLs and
+// judge staleness on a later hit.
+type cacheEntry struct {
+	packed   []byte
+	storedAt time.Time
+	ttl      time.Duration
+}
+
+// forwardCache is the storage backing the forward response cache; it has
+// an in-memory (lruForwardCache) and a badger-backed implementation,
+// chosen in main() depending on whether -store is set.
+type forwardCache interface {
+	get(key cacheKey) (*cacheEntry, bool)
+	set(key cacheKey, entry cacheEntry)
+}
+
+// cacheTTL derives the duration a response may be cached for: the
+// minimum answer TTL for a successful answer, or the SOA MINIMUM field
+// (RFC 2308) for a negative (NXDOMAIN/NODATA) response. A zero ttl means
+// the response must not be cached.
+func cacheTTL(resp *dns.Msg) uint32 {
+	if t, has := minAnswerTTL(resp); has {
+		return t
+	}
+	if resp.Rcode == dns.RcodeNameError || (resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0) {
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return soa.Minttl
+			}
+		}
+	}
+	return 0
+}
+
+// decrementTTL subtracts age (in whole seconds) from every RR's TTL in
+// msg, flooring at zero, so a cached response's remaining lifetime is
+// reflected accurately to the client.
+func decrementTTL(msg *dns.Msg, age time.Duration) {
+	secs := uint32(age.Seconds())
+	dec := func(rrs []dns.RR) {
+		for _, rr := range rrs {
+			hdr := rr.Header()
+			if hdr.Ttl > secs {
+				hdr.Ttl -= secs
+			} else {
+				hdr.Ttl = 0
+			}
+		}
+	}
+	dec(msg.Answer)
+	dec(msg.Ns)
+	dec(msg.Extra)
+}
+
+// cacheLookup returns the cached response for key, unpacked and with its
+// TTLs decremented by its age. A stale entry (past its TTL) is only
+// returned when allowStale is set and still within h.ServeStale of
+// expiry, per RFC 8767.
+func (h *handler) cacheLookup(key cacheKey, allowStale bool) (*dns.Msg, bool) {
+	if h.Cache == nil {
+		return nil, false
+	}
+	entry, ok := h.Cache.get(key)
+	if !ok {
+		return nil, false
+	}
+	age := time.Since(entry.storedAt)
+	if age >= entry.ttl {
+		if !allowStale || h.ServeStale <= 0 || age >= entry.ttl+h.ServeStale {
+			return nil, false
+		}
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(entry.packed); err != nil {
+		return nil, false
+	}
+	decrementTTL(msg, age)
+	return msg, true
+}
+
+// cacheStore saves resp under key if its TTL/SOA MINIMUM allows caching.
+func (h *handler) cacheStore(key cacheKey, resp *dns.Msg) {
+	if h.Cache == nil {
+		return
+	}
+	ttl := cacheTTL(resp)
+	if ttl == 0 {
+		return
+	}
+	packed, err := resp.Pack()
+	if err != nil {
+		return
+	}
+	h.Cache.set(key, cacheEntry{packed: packed, storedAt: time.Now(), ttl: time.Duration(ttl) * time.Second})
+}
+
+// lruEntry is the payload of a lruForwardCache list element.
+type lruEntry struct {
+	key   string
+	entry cacheEntry
+}
+
+// lruForwardCache is the in-memory forward cache used when -store isn't
+// set, bounded to capacity entries, oldest-accessed evicted first.
+type lruForwardCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	items    map[string]*list.Element
+}
+
+func newLRUForwardCache(capacity int) *lruForwardCache {
+	return &lruForwardCache{capacity: capacity, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *lruForwardCache) get(key cacheKey) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key.encode()]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	entry := el.Value.(*lruEntry).entry
+	return &entry, true
+}
+
+func (c *lruForwardCache) set(key cacheKey, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := key.encode()
+	if el, ok := c.items[k]; ok {
+		el.Value.(*lruEntry).entry = entry
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[k] = c.order.PushFront(&lruEntry{key: k, entry: entry})
+	if c.capacity > 0 && c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest != nil {
+			c.order.Remove(oldest)
+			delete(c.items, oldest.Value.(*lruEntry).key)
+		}
+	}
+}
+
+// cacheRecord is the JSON form a cacheEntry takes in badger, since the
+// store has no notion of our cacheEntry's unexported fields.
+type cacheRecord struct {
+	Packed   []byte        `json:"packed"`
+	StoredAt time.Time     `json:"stored_at"`
+	TTL      time.Duration `json:"ttl"`
+}
+
+// badgerForwardCache is the forward cache used when -store is set; it
+// shares the same badger.DB as the PTR cache, keyed under fwdKeyPrefix.
+type badgerForwardCache struct {
+	db *badger.DB
+}
+
+func (c *badgerForwardCache) get(key cacheKey) (*cacheEntry, bool) {
+	var rec cacheRecord
+	err := c.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(fwdKeyPrefix + key.encode()))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(v []byte) error { return json.Unmarshal(v, &rec) })
+	})
+	if err != nil {
+		return nil, false
+	}
+	return &cacheEntry{packed: rec.Packed, storedAt: rec.StoredAt, ttl: rec.TTL}, true
+}
+
+func (c *badgerForwardCache) set(key cacheKey, entry cacheEntry) {
+	data, err := json.Marshal(cacheRecord{Packed: entry.packed, StoredAt: entry.storedAt, TTL: entry.ttl})
+	if err != nil {
+		return
+	}
+	if err := c.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(fwdKeyPrefix+key.encode()), data)
+	}); err != nil {
+		log.Printf("Cannot store forward cache entry: %s", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func answerMsg(ttls ...uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	for _, ttl := range ttls {
+		m.Answer = append(m.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		})
+	}
+	return m
+}
+
+func negativeMsg(rcode int, minttl uint32) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Rcode = rcode
+	m.Ns = append(m.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET},
+		Minttl: minttl,
+	})
+	return m
+}
+
+func TestCacheTTLUsesLowestAnswerTTL(t *testing.T) {
+	if got := cacheTTL(answerMsg(300, 60, 120)); got != 60 {
+		t.Errorf("cacheTTL = %d, want 60", got)
+	}
+}
+
+func TestCacheTTLNegativeUsesSOAMinimum(t *testing.T) {
+	if got := cacheTTL(negativeMsg(dns.RcodeNameError, 45)); got != 45 {
+		t.Errorf("cacheTTL(NXDOMAIN) = %d, want 45", got)
+	}
+	if got := cacheTTL(negativeMsg(dns.RcodeSuccess, 30)); got != 30 {
+		t.Errorf("cacheTTL(NODATA) = %d, want 30", got)
+	}
+}
+
+func TestCacheTTLUncacheableWithoutSOA(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Rcode = dns.RcodeNameError
+	if got := cacheTTL(m); got != 0 {
+		t.Errorf("cacheTTL = %d, want 0 for an NXDOMAIN with no SOA", got)
+	}
+}
+
+func TestDecrementTTLFloorsAtZero(t *testing.T) {
+	msg := answerMsg(10, 3)
+	decrementTTL(msg, 5*time.Second)
+	if msg.Answer[0].Header().Ttl != 5 {
+		t.Errorf("Answer[0].Ttl = %d, want 5", msg.Answer[0].Header().Ttl)
+	}
+	if msg.Answer[1].Header().Ttl != 0 {
+		t.Errorf("Answer[1].Ttl = %d, want 0 (floored, not negative)", msg.Answer[1].Header().Ttl)
+	}
+}
+
+func TestCacheLookupFreshHit(t *testing.T) {
+	h := &handler{Cache: newLRUForwardCache(10)}
+	key := cacheKeyFor(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, "")
+	resp := answerMsg(60)
+	packed, err := resp.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %s", err)
+	}
+	h.Cache.set(key, cacheEntry{packed: packed, storedAt: time.Now(), ttl: 60 * time.Second})
+
+	msg, ok := h.cacheLookup(key, false)
+	if !ok || msg == nil {
+		t.Fatalf("cacheLookup = (%v, %v), want a fresh hit", msg, ok)
+	}
+}
+
+func TestCacheLookupExpiredWithoutServeStale(t *testing.T) {
+	h := &handler{Cache: newLRUForwardCache(10)}
+	key := cacheKeyFor(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, "")
+	resp := answerMsg(60)
+	packed, _ := resp.Pack()
+	h.Cache.set(key, cacheEntry{packed: packed, storedAt: time.Now().Add(-90 * time.Second), ttl: 60 * time.Second})
+
+	if _, ok := h.cacheLookup(key, true); ok {
+		t.Errorf("cacheLookup = ok, want a miss: entry is expired and ServeStale is disabled")
+	}
+}
+
+func TestCacheLookupServesStaleWithinWindow(t *testing.T) {
+	h := &handler{Cache: newLRUForwardCache(10), ServeStale: 30 * time.Second}
+	key := cacheKeyFor(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, "")
+	resp := answerMsg(60)
+	packed, _ := resp.Pack()
+	h.Cache.set(key, cacheEntry{packed: packed, storedAt: time.Now().Add(-70 * time.Second), ttl: 60 * time.Second})
+
+	if _, ok := h.cacheLookup(key, false); ok {
+		t.Errorf("cacheLookup(allowStale=false) = ok, want a miss past TTL")
+	}
+	if _, ok := h.cacheLookup(key, true); !ok {
+		t.Errorf("cacheLookup(allowStale=true) = miss, want a stale hit within the ServeStale window")
+	}
+}
+
+func TestCacheLookupPastServeStaleWindow(t *testing.T) {
+	h := &handler{Cache: newLRUForwardCache(10), ServeStale: 10 * time.Second}
+	key := cacheKeyFor(dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}, "")
+	resp := answerMsg(60)
+	packed, _ := resp.Pack()
+	h.Cache.set(key, cacheEntry{packed: packed, storedAt: time.Now().Add(-90 * time.Second), ttl: 60 * time.Second})
+
+	if _, ok := h.cacheLookup(key, true); ok {
+		t.Errorf("cacheLookup = ok, want a miss: entry is past TTL+ServeStale")
+	}
+}
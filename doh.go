@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+)
+
+const dohMediaType = "application/dns-message"
+
+// dohAddr is the net.Addr dns.ResponseWriter implementations are
+// required to expose as their local address; DoH clients never query it.
+type dohAddr struct{}
+
+func (dohAddr) Network() string { return "tcp" }
+func (dohAddr) String() string  { return "" }
+
+// dohResponseWriter adapts an http.ResponseWriter so that the regular
+// handler.ServeDNS code path can answer DNS-over-HTTPS requests.
+type dohResponseWriter struct {
+	w          http.ResponseWriter
+	remoteAddr net.Addr
+}
+
+func (d *dohResponseWriter) LocalAddr() net.Addr  { return dohAddr{} }
+func (d *dohResponseWriter) RemoteAddr() net.Addr { return d.remoteAddr }
+func (d *dohResponseWriter) Close() error         { return nil }
+func (d *dohResponseWriter) TsigStatus() error    { return nil }
+func (d *dohResponseWriter) TsigTimersOnly(bool)  {}
+func (d *dohResponseWriter) Hijack()              {}
+
+func (d *dohResponseWriter) Write(b []byte) (int, error) {
+	return d.w.Write(b)
+}
+
+func (d *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	packed, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	d.w.Header().Set("Content-Type", dohMediaType)
+	if ttl, has := minAnswerTTL(m); has {
+		d.w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	d.w.WriteHeader(http.StatusOK)
+	_, err = d.w.Write(packed)
+	return err
+}
+
+// minAnswerTTL returns the lowest TTL among m's answer records, so DoH
+// responses can be cached by intermediaries for no longer than that.
+func minAnswerTTL(m *dns.Msg) (min uint32, has bool) {
+	for _, rr := range m.Answer {
+		if ttl := rr.Header().Ttl; !has || ttl < min {
+			min, has = ttl, true
+		}
+	}
+	return
+}
+
+func remoteAddrFromRequest(req *http.Request) net.Addr {
+	host, port, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return &net.TCPAddr{IP: net.ParseIP(req.RemoteAddr)}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// dohHandler answers RFC 8484 DNS-over-HTTPS requests on path by
+// decoding the wire-format message and running it through h.ServeDNS,
+// same as any other listener.
+func (h *handler) dohHandler(path string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+		var msg []byte
+		var err error
+		switch req.Method {
+		case http.MethodGet:
+			q := req.URL.Query().Get("dns")
+			if q == "" {
+				http.Error(w, "missing dns parameter", http.StatusBadRequest)
+				return
+			}
+			msg, err = base64.RawURLEncoding.DecodeString(q)
+		case http.MethodPost:
+			if ct := req.Header.Get("Content-Type"); ct != dohMediaType {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			msg, err = ioutil.ReadAll(req.Body)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err != nil {
+			http.Error(w, "malformed request", http.StatusBadRequest)
+			return
+		}
+		r := &dns.Msg{}
+		if err := r.Unpack(msg); err != nil {
+			http.Error(w, "malformed dns message", http.StatusBadRequest)
+			return
+		}
+		h.ServeDNS(&dohResponseWriter{w: w, remoteAddr: remoteAddrFromRequest(req)}, r)
+	})
+	return mux
+}
+
+// ListenAndServeDoH starts an HTTP/2 DNS-over-HTTPS listener on addr,
+// serving queries on path (default "/dns-query", see RFC 8484) using
+// cert for TLS.
+func (h *handler) ListenAndServeDoH(addr, path string, cert tls.Certificate) error {
+	srv := &http.Server{
+		Addr:      addr,
+		Handler:   h.dohHandler(path),
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+	}
+	if err := http2.ConfigureServer(srv, &http2.Server{}); err != nil {
+		return err
+	}
+	log.Printf("DoH ListenAndServeTLS on %s%s", addr, path)
+	return srv.ListenAndServeTLS("", "")
+}
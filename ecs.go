@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ECS modes accepted by the -ecs flag; "synthesize=<ip>" is parsed
+// separately by parseECSMode into the synthesize mode plus its address.
+const (
+	ECSOff         = "off"
+	ECSPassthrough = "passthrough"
+	ECSStrip       = "strip"
+	ECSSynthesize  = "synthesize"
+
+	ecsSynthesizePrefix = "synthesize="
+)
+
+// parseECSMode splits a -ecs flag value into its mode and, for
+// "synthesize=<ip>", the address to report for every client.
+func parseECSMode(value string) (mode string, synthesize net.IP, err error) {
+	if strings.HasPrefix(value, ecsSynthesizePrefix) {
+		ipStr := strings.TrimPrefix(value, ecsSynthesizePrefix)
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return "", nil, fmt.Errorf("invalid -ecs synthesize address %#v", ipStr)
+		}
+		return ECSSynthesize, ip, nil
+	}
+	switch value {
+	case "":
+		return ECSOff, nil, nil
+	case ECSOff, ECSPassthrough, ECSStrip:
+		return value, nil, nil
+	default:
+		return "", nil, fmt.Errorf("unrecognized -ecs mode %#v", value)
+	}
+}
+
+// maskIP truncates ip to its leading prefixLen bits, as sent in an ECS
+// option's SOURCE PREFIX-LENGTH field.
+func maskIP(ip net.IP, prefixLen int) net.IP {
+	bits := len(ip) * 8
+	if prefixLen > bits {
+		prefixLen = bits
+	}
+	return ip.Mask(net.CIDRMask(prefixLen, bits))
+}
+
+// applyECS sets, strips, or rewrites the EDNS Client Subnet option on
+// the outgoing query r per h.ECSMode before it's forwarded upstream.
+// In every mode but off, any ECS option the client itself supplied is
+// removed before the mode's own option (if any) is added; off leaves r
+// untouched.
+func (h *handler) applyECS(r *dns.Msg, client net.IP) {
+	if h.ECSMode == "" || h.ECSMode == ECSOff {
+		return
+	}
+	opt := r.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		r.Extra = append(r.Extra, opt)
+	}
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != dns.EDNS0SUBNET {
+			kept = append(kept, o)
+		}
+	}
+	opt.Option = kept
+	if h.ECSMode == ECSStrip {
+		return
+	}
+
+	subnet := client
+	if h.ECSMode == ECSSynthesize {
+		subnet = h.ECSSynthesizeIP
+	}
+	if subnet == nil {
+		return
+	}
+
+	family := uint16(1)
+	prefixLen := h.ECSv4Prefix
+	if v4 := subnet.To4(); v4 != nil {
+		subnet = v4
+	} else {
+		family = 2
+		prefixLen = h.ECSv6Prefix
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        family,
+		SourceNetmask: uint8(prefixLen),
+		Address:       maskIP(subnet, prefixLen),
+	})
+}
+
+// ecsSubnetKey returns the string a forward-cache key is segmented by so
+// that ECS-varying answers for different client subnets never collide:
+// the client's masked subnet in passthrough mode, the synthesized
+// address in synthesize mode, and empty otherwise.
+func (h *handler) ecsSubnetKey(client net.IP) string {
+	switch h.ECSMode {
+	case ECSPassthrough:
+		if client == nil {
+			return ""
+		}
+		if v4 := client.To4(); v4 != nil {
+			return maskIP(v4, h.ECSv4Prefix).String()
+		}
+		return maskIP(client, h.ECSv6Prefix).String()
+	case ECSSynthesize:
+		return h.ECSSynthesizeIP.String()
+	default:
+		return ""
+	}
+}
+
+// serverCookie derives the 8-byte Server Cookie (RFC 7873) for
+// clientCookie and the querying client's address. The derivation is
+// server-chosen by the RFC; we use HMAC-SHA256 truncated to 8 bytes.
+func (h *handler) serverCookie(clientCookie []byte, client net.IP) []byte {
+	mac := hmac.New(sha256.New, h.cookieSecret[:])
+	mac.Write(clientCookie)
+	mac.Write(client)
+	return mac.Sum(nil)[:8]
+}
+
+// checkCookie validates the DNS Cookie (RFC 7873) option on r, if any,
+// as an anti-spoofing measure complementing checkNoDoS's debounce. It
+// returns ok=false when a Server Cookie was presented but doesn't
+// validate, meaning the caller should reject with BADCOOKIE. respCookie,
+// when non-nil, is the Cookie option value the response should echo back
+// (e.g. to hand a first-time client its Server Cookie).
+func (h *handler) checkCookie(r *dns.Msg, client net.IP) (ok bool, respCookie []byte) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return true, nil
+	}
+	for _, o := range opt.Option {
+		cookie, isCookie := o.(*dns.EDNS0_COOKIE)
+		if !isCookie {
+			continue
+		}
+		raw, err := hex.DecodeString(cookie.Cookie)
+		if err != nil || len(raw) < 8 {
+			return false, nil
+		}
+		clientCookie := raw[:8]
+		want := h.serverCookie(clientCookie, client)
+		respCookie = append(append([]byte{}, clientCookie...), want...)
+		if len(raw) == 8 {
+			return true, respCookie
+		}
+		return hmac.Equal(raw[8:], want), respCookie
+	}
+	return true, nil
+}
+
+// attachCookie sets resp's DNS Cookie option to cookie (as produced by
+// checkCookie), creating the OPT record if the response doesn't have
+// one yet.
+func attachCookie(resp *dns.Msg, cookie []byte) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		opt = &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		resp.Extra = append(resp.Extra, opt)
+	}
+	kept := opt.Option[:0]
+	for _, o := range opt.Option {
+		if _, isCookie := o.(*dns.EDNS0_COOKIE); !isCookie {
+			kept = append(kept, o)
+		}
+	}
+	opt.Option = append(kept, &dns.EDNS0_COOKIE{Code: dns.EDNS0COOKIE, Cookie: hex.EncodeToString(cookie)})
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// Block modes accepted by the -blockmode flag. Any other value is parsed
+// as the sinkhole IP address to answer with instead.
+const (
+	BlockModeNXDomain = "nxdomain"
+	BlockModeZero     = "zero"
+)
+
+// filterRule is what a blocklist/allowlist line contributes to a single
+// trie node: whether it blocks, whether it's an exception to a block,
+// and whether it's marked $important (wins over exceptions).
+type filterRule struct {
+	blocked   bool
+	allowed   bool
+	important bool
+}
+
+// filterNode is one label of the suffix trie backing the filter lists;
+// the most specific (deepest) node with a rule along a query's path wins,
+// unless some node along that path has a $important rule, in which case
+// the deepest such node wins instead. Both exact hosts-file entries and ||domain.tld^-style suffix rules
+// share the same O(labels) lookup.
+type filterNode struct {
+	children map[string]*filterNode
+	rule     *filterRule
+}
+
+func newFilterNode() *filterNode {
+	return &filterNode{children: map[string]*filterNode{}}
+}
+
+func (n *filterNode) add(domain string) *filterRule {
+	node := n
+	for _, label := range labels(domain) {
+		child, ok := node.children[label]
+		if !ok {
+			child = newFilterNode()
+			node.children[label] = child
+		}
+		node = child
+	}
+	if node.rule == nil {
+		node.rule = &filterRule{}
+	}
+	return node.rule
+}
+
+func (n *filterNode) lookup(qName string) *filterRule {
+	node := n
+	var best, important *filterRule
+	for _, label := range labels(qName) {
+		child, ok := node.children[label]
+		if !ok {
+			break
+		}
+		node = child
+		if node.rule != nil {
+			best = node.rule
+			if node.rule.important {
+				important = node.rule
+			}
+		}
+	}
+	if important != nil {
+		return important
+	}
+	return best
+}
+
+// filterSet is the compiled form of every -blocklist file, swapped in
+// atomically on load/reload so lookups never observe a half-built trie.
+type filterSet struct {
+	root *filterNode
+}
+
+func (fs *filterSet) blocked(qName string) bool {
+	if fs == nil || fs.root == nil {
+		return false
+	}
+	rule := fs.root.lookup(qName)
+	if rule == nil || !rule.blocked {
+		return false
+	}
+	return !rule.allowed || rule.important
+}
+
+// loadFilterSet reads every path in order and compiles a new filterSet.
+// Hosts-format lines ("<ip> <host...>") and Adblock-style lines
+// (||domain^, @@||domain^ exceptions, $important modifier) may be mixed
+// freely within and across files.
+func loadFilterSet(paths []string) (*filterSet, error) {
+	fs := &filterSet{root: newFilterNode()}
+	for _, path := range paths {
+		if err := fs.loadFile(path); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return fs, nil
+}
+
+func (fs *filterSet) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "!") {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||"):
+			fs.addAdblockRule(line)
+		default:
+			fs.addHostsLine(line)
+		}
+	}
+	return scanner.Err()
+}
+
+// addHostsLine handles "<ip> <hostname...>" /etc/hosts-format lines,
+// blocking every hostname listed on the line.
+func (fs *filterSet) addHostsLine(line string) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 {
+		return
+	}
+	if net.ParseIP(fields[0]) == nil {
+		return
+	}
+	for _, host := range fields[1:] {
+		fs.root.add(strings.TrimSuffix(host, ".")).blocked = true
+	}
+}
+
+// addAdblockRule handles a single Adblock-syntax line: "||domain^",
+// optionally prefixed with "@@" for an allow exception and suffixed
+// with "$important" or other comma-separated modifiers.
+func (fs *filterSet) addAdblockRule(line string) {
+	allow := strings.HasPrefix(line, "@@")
+	line = strings.TrimPrefix(line, "@@")
+	line = strings.TrimPrefix(line, "||")
+
+	important := false
+	if dollar := strings.Index(line, "$"); dollar >= 0 {
+		for _, mod := range strings.Split(line[dollar+1:], ",") {
+			if mod == "important" {
+				important = true
+			}
+		}
+		line = line[:dollar]
+	}
+	domain := strings.TrimSuffix(line, "^")
+	if domain == "" {
+		return
+	}
+	rule := fs.root.add(domain)
+	if allow {
+		rule.allowed = true
+	} else {
+		rule.blocked = true
+	}
+	if important {
+		rule.important = true
+	}
+}
+
+// blockResponse builds the reply sent instead of forwarding a blocked
+// query, shaped by mode: "nxdomain" (default), "zero" (0.0.0.0/::), or
+// a literal sinkhole IP address.
+func blockResponse(r *dns.Msg, mode string) *dns.Msg {
+	m := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id: r.Id, Response: true,
+			RecursionDesired: r.RecursionDesired, RecursionAvailable: true,
+		},
+		Question: r.Question,
+	}
+	q := r.Question[0]
+
+	switch {
+	case mode == "" || mode == BlockModeNXDomain:
+		m.Rcode = dns.RcodeNameError
+		return m
+	case mode == BlockModeZero:
+		return sinkholeAnswer(m, q, net.IPv4zero, net.IPv6zero)
+	default:
+		if ip := net.ParseIP(mode); ip != nil {
+			return sinkholeAnswer(m, q, ip, ip)
+		}
+		log.Printf("Unrecognized -blockmode %#v, falling back to NXDOMAIN", mode)
+		m.Rcode = dns.RcodeNameError
+		return m
+	}
+}
+
+func sinkholeAnswer(m *dns.Msg, q dns.Question, v4, v6 net.IP) *dns.Msg {
+	switch q.Qtype {
+	case dns.TypeA:
+		if ip := v4.To4(); ip != nil {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: q.Qclass, Ttl: 60}, A: ip})
+			return m
+		}
+	case dns.TypeAAAA:
+		if ip := v6.To16(); ip != nil && v6.To4() == nil {
+			m.Answer = append(m.Answer, &dns.AAAA{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: q.Qclass, Ttl: 60}, AAAA: ip})
+			return m
+		}
+	}
+	m.Rcode = dns.RcodeNameError
+	return m
+}
+
+// filterState holds the swappable *filterSet plus the match counter,
+// so ServeDNS can check/reload it without locking on every query.
+type filterState struct {
+	set     atomic.Value // *filterSet
+	matched uint64
+}
+
+func (fst *filterState) current() *filterSet {
+	s, _ := fst.set.Load().(*filterSet)
+	return s
+}
+
+func (fst *filterState) reload(paths []string) error {
+	fs, err := loadFilterSet(paths)
+	if err != nil {
+		return err
+	}
+	fst.set.Store(fs)
+	return nil
+}
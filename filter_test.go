@@ -0,0 +1,62 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func loadFilterSetFromLines(t *testing.T, lines ...string) *filterSet {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "list.txt")
+	content := ""
+	for _, line := range lines {
+		content += line + "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	fs, err := loadFilterSet([]string{path})
+	if err != nil {
+		t.Fatalf("loadFilterSet: %s", err)
+	}
+	return fs
+}
+
+func TestFilterSetBlocksSuffix(t *testing.T) {
+	fs := loadFilterSetFromLines(t, "||ads.example^")
+	if !fs.blocked("ads.example") {
+		t.Errorf("blocked(%q) = false, want true", "ads.example")
+	}
+	if !fs.blocked("sub.ads.example") {
+		t.Errorf("blocked(%q) = false, want true", "sub.ads.example")
+	}
+	if fs.blocked("notads.example") {
+		t.Errorf("blocked(%q) = true, want false", "notads.example")
+	}
+}
+
+func TestFilterSetAllowExceptionOverridesBlock(t *testing.T) {
+	fs := loadFilterSetFromLines(t, "||ads.example^", "@@||good.ads.example^")
+	if !fs.blocked("other.ads.example") {
+		t.Errorf("blocked(%q) = false, want true", "other.ads.example")
+	}
+	if fs.blocked("good.ads.example") {
+		t.Errorf("blocked(%q) = true, want false: @@ exception should override the block", "good.ads.example")
+	}
+}
+
+func TestFilterSetImportantOverridesException(t *testing.T) {
+	fs := loadFilterSetFromLines(t, "||ads.example^$important", "@@||ads.example^")
+	if !fs.blocked("ads.example") {
+		t.Errorf("blocked(%q) = false, want true: $important should win over the @@ exception", "ads.example")
+	}
+}
+
+func TestFilterSetHostsLineBlocks(t *testing.T) {
+	fs := loadFilterSetFromLines(t, "0.0.0.0 tracker.example other.example")
+	if !fs.blocked("tracker.example") || !fs.blocked("other.example") {
+		t.Errorf("expected both hostnames on the hosts-format line to be blocked")
+	}
+}
@@ -1,15 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"errors"
 	"flag"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -17,6 +22,11 @@ import (
 	"github.com/miekg/dns"
 )
 
+// errNoUpstreamErr is returned, wrapped in errNoUpstream, when no route
+// matches a query name; the strategies also return it unwrapped when
+// every upstream answered without an error but with SERVFAIL.
+var errNoUpstreamErr = errors.New("no upstream server set")
+
 type debounceInfo struct {
 	tm  time.Time
 	cnt int
@@ -25,16 +35,30 @@ type debounceInfo struct {
 type handler struct {
 	dns.Handler
 	ClientTimeout      time.Duration
-	clients            map[string]*dns.Client
-	servers            map[string]string
+	routes             *domainTrie
+	Strategy           string
+	dohClient          *http.Client
+	Filters            *filterState
+	BlockMode          string
 	ptrMap             map[string]string
 	lastResultSent     map[string]debounceInfo
 	lastResultSentLock sync.Mutex
 	ptrMapLock         sync.Mutex
 	DebounceDelay      time.Duration
 	DebounceCount      int
+	DebounceDrops      uint64
 	StoreDB            *badger.DB
 	IsSilent           bool
+	Metrics            *queryMetrics
+	QueryLog           *queryLogger
+	Cache              forwardCache
+	ServeStale         time.Duration
+	ECSMode            string
+	ECSSynthesizeIP    net.IP
+	ECSv4Prefix        int
+	ECSv6Prefix        int
+	CookiesEnabled     bool
+	cookieSecret       [16]byte
 }
 
 func (h *handler) checkNoDoS(w dns.ResponseWriter) bool {
@@ -52,6 +76,7 @@ func (h *handler) checkNoDoS(w dns.ResponseWriter) bool {
 				log.Printf("Debounce delay (%s) since last reply not passed, count = %d / %d",
 					h.DebounceDelay, lastReply.cnt, h.DebounceCount)
 				if lastReply.cnt <= 0 {
+					atomic.AddUint64(&h.DebounceDrops, 1)
 					return false
 				}
 				h.lastResultSent[ip] = debounceInfo{tm: time.Now(), cnt: lastReply.cnt - 1}
@@ -75,9 +100,15 @@ func (h *handler) writeMsg(w dns.ResponseWriter, r *dns.Msg) error {
 
 type errNoUpstream error
 
+// SetUpstream (re)builds the domain-suffix routing trie from upstream
+// specs of the form "[.domain=][proto://]host:port", proto one of udp,
+// tcp, tcp-tls or https. Several specs sharing the same domain become
+// candidates for h.Strategy instead of the first one always winning.
 func (h *handler) SetUpstream(upstream []string) {
-	h.clients = map[string]*dns.Client{}
-	h.servers = map[string]string{}
+	h.routes = newDomainTrie()
+	if h.dohClient == nil {
+		h.dohClient = &http.Client{Timeout: h.ClientTimeout}
+	}
 	for _, up := range upstream {
 		domain := ""
 		proto := "udp"
@@ -87,28 +118,28 @@ func (h *handler) SetUpstream(upstream []string) {
 		if protoIdx := strings.Index(up, "://"); protoIdx >= 0 {
 			proto, up = up[:protoIdx], up[protoIdx+3:]
 		}
-		h.clients[domain] = &dns.Client{Net: proto, Timeout: h.ClientTimeout}
-		h.servers[domain] = up
+		var u Upstream
+		if proto == "https" {
+			u = &httpsUpstream{url: "https://" + up, client: h.dohClient}
+		} else {
+			u = &dnsUpstream{client: &dns.Client{Net: proto, Timeout: h.ClientTimeout}, addr: up}
+		}
+		h.routes.add(domain, &trackedUpstream{Upstream: u, metrics: h.Metrics})
 	}
 }
 
-func (h *handler) upstreamExchange(r *dns.Msg) (*dns.Msg, time.Duration, error) {
+func (h *handler) upstreamExchange(r *dns.Msg) (*dns.Msg, time.Duration, string, error) {
 	qName := strings.TrimSuffix(r.Question[0].Name, ".")
-	for dotIdx, domain := 0, qName; dotIdx >= 0; dotIdx = strings.Index(domain, ".") {
-		domain = domain[dotIdx:]
-		if cl, have := h.clients[domain]; have {
-			log.Printf("[%02x] will use %s for %s", r.Id, h.servers[domain], domain)
-			return cl.Exchange(r, h.servers[domain])
-		}
-		if dotIdx > 0 {
-			domain = domain[1:]
-		}
+	route := h.routes.lookup(qName)
+	if route == nil || len(route.upstreams) == 0 {
+		return nil, 0, "", errNoUpstream(errNoUpstreamErr)
 	}
-
-	if cl, have := h.clients[""]; have {
-		return cl.Exchange(r, h.servers[""])
+	strategy := h.Strategy
+	if strategy == "" {
+		strategy = StrategyFailover
 	}
-	return nil, 0, errNoUpstream(errors.New("no upstream server set"))
+	log.Printf("[%02x] will use %s strategy over %d upstream(s) for %s", r.Id, strategy, len(route.upstreams), qName)
+	return exchangeStrategy(context.Background(), strategy, route, r)
 }
 
 func (h *handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
@@ -116,6 +147,28 @@ func (h *handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		log.Printf("Dropping, DoS check failed to %s", w.RemoteAddr())
 		return
 	}
+	ip := clientIP(w)
+	var cookieResp []byte
+	if h.CookiesEnabled {
+		var ok bool
+		if ok, cookieResp = h.checkCookie(r, ip); !ok {
+			if !h.IsSilent {
+				log.Printf("Rejecting query from %s: bad DNS cookie", w.RemoteAddr())
+			}
+			resp := &dns.Msg{MsgHdr: dns.MsgHdr{Id: r.Id, Response: true, Rcode: dns.RcodeBadCookie}, Question: r.Question}
+			if cookieResp != nil {
+				attachCookie(resp, cookieResp)
+			}
+			_ = h.writeMsg(w, resp)
+			return
+		}
+	}
+	write := func(resp *dns.Msg) {
+		if cookieResp != nil {
+			attachCookie(resp, cookieResp)
+		}
+		_ = h.writeMsg(w, resp)
+	}
 	if h.ptrMap == nil {
 		h.ptrMap = make(map[string]string)
 	}
@@ -127,13 +180,18 @@ func (h *handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	if !h.IsSilent {
 		log.Printf("Query from %s: %s", w.RemoteAddr(), q.String())
 	}
+	client := clientIPString(w)
+	if h.Metrics != nil {
+		h.Metrics.observeQuery(dns.TypeToString[q.Qtype], client)
+	}
 
 	if q.Qtype == dns.TypePTR && q.Qclass == dns.ClassINET {
 		if v, has := h.ptrMap[q.Name]; has {
 			if !h.IsSilent {
 				log.Printf("Replying with cached PTR: %#v = %#v", q.Name, v)
 			}
-			_ = h.writeMsg(w, &dns.Msg{
+			h.logQuery(client, q, nil, "", 0, true, dns.RcodeSuccess)
+			write(&dns.Msg{
 				MsgHdr:   dns.MsgHdr{Id: r.MsgHdr.Id, Response: true, RecursionDesired: r.RecursionDesired, RecursionAvailable: true},
 				Question: r.Question,
 				Answer: []dns.RR{&dns.PTR{
@@ -146,29 +204,66 @@ func (h *handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 	}
 	if !r.RecursionDesired {
 		log.Printf("[%02x] Client %s doesn't want recursion", r.Id, w.RemoteAddr())
-		_ = h.writeMsg(w, &dns.Msg{
+		write(&dns.Msg{
 			MsgHdr: dns.MsgHdr{Id: r.MsgHdr.Id, Response: true, Rcode: dns.RcodeServerFailure}})
 		return
 	}
-	resp, rtt, err := h.upstreamExchange(r)
+	if h.Filters != nil {
+		if fs := h.Filters.current(); fs.blocked(strings.TrimSuffix(q.Name, ".")) {
+			atomic.AddUint64(&h.Filters.matched, 1)
+			if !h.IsSilent {
+				log.Printf("[%02x] Blocked %s (%s)", r.Id, q.Name, h.BlockMode)
+			}
+			blocked := blockResponse(r, h.BlockMode)
+			h.logQuery(client, q, nil, "", 0, false, blocked.Rcode)
+			write(blocked)
+			return
+		}
+	}
+	cacheKey := cacheKeyFor(q, h.ecsSubnetKey(ip))
+	if cached, ok := h.cacheLookup(cacheKey, false); ok {
+		cached.Id = r.Id
+		if !h.IsSilent {
+			log.Printf("[%02x] Replying from forward cache: %s", r.Id, q.String())
+		}
+		h.logQuery(client, q, cached.Answer, "cache", 0, true, cached.Rcode)
+		write(cached)
+		return
+	}
+
+	h.applyECS(r, ip)
+	resp, rtt, upstream, err := h.upstreamExchange(r)
 	if err != nil {
 		log.Printf("[%02x] Error getting response: %s", r.Id, err)
 		switch err.(type) {
 		case *net.OpError, errNoUpstream:
-			h.writeMsg(w,
-				&dns.Msg{
-					MsgHdr: dns.MsgHdr{
-						Id: r.MsgHdr.Id, Response: true,
-						RecursionDesired: r.RecursionDesired, RecursionAvailable: true,
-						Rcode: dns.RcodeServerFailure,
-					},
-					Question: r.Question})
+			if h.ServeStale > 0 {
+				if stale, ok := h.cacheLookup(cacheKey, true); ok {
+					stale.Id = r.Id
+					if !h.IsSilent {
+						log.Printf("[%02x] Serving stale cache entry for %s after upstream error", r.Id, q.String())
+					}
+					h.logQuery(client, q, stale.Answer, "cache-stale", 0, true, stale.Rcode)
+					write(stale)
+					return
+				}
+			}
+			h.logQuery(client, q, nil, upstream, rtt, false, dns.RcodeServerFailure)
+			write(&dns.Msg{
+				MsgHdr: dns.MsgHdr{
+					Id: r.MsgHdr.Id, Response: true,
+					RecursionDesired: r.RecursionDesired, RecursionAvailable: true,
+					Rcode: dns.RcodeServerFailure,
+				},
+				Question: r.Question})
 		}
 		return
 	}
 	if !h.IsSilent {
 		log.Printf("[%02x] Got response (rtt=%s)\n%s", r.Id, rtt, resp)
 	}
+	h.logQuery(client, q, resp.Answer, upstream, rtt, false, resp.Rcode)
+	h.cacheStore(cacheKey, resp)
 	for _, answ := range resp.Answer {
 		addrString := ""
 		switch a := answ.(type) {
@@ -189,7 +284,7 @@ func (h *handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 		h.ptrMapLock.Unlock()
 		if h.StoreDB != nil {
 			if err := h.StoreDB.Update(func(txn *badger.Txn) error {
-				if err := txn.Set([]byte(ptr), []byte(q.Name)); err != nil {
+				if err := txn.Set([]byte(ptrKeyPrefix+ptr), []byte(q.Name)); err != nil {
 					return err
 				}
 				return nil
@@ -201,7 +296,57 @@ func (h *handler) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
 			log.Printf("caching answer for %s as %s (%s)", addrString, q.Name, ptr)
 		}
 	}
-	_ = h.writeMsg(w, resp)
+	write(resp)
+}
+
+// clientIP extracts the querying client's address from w, regardless of
+// whether it arrived over UDP, TCP(-TLS) or DoH; nil if w's RemoteAddr
+// isn't IP-based.
+func clientIP(w dns.ResponseWriter) net.IP {
+	switch a := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	default:
+		return nil
+	}
+}
+
+// clientIPString is clientIP formatted for logging/metrics labels,
+// falling back to RemoteAddr's own String() when it isn't IP-based.
+func clientIPString(w dns.ResponseWriter) string {
+	if ip := clientIP(w); ip != nil {
+		return ip.String()
+	}
+	return w.RemoteAddr().String()
+}
+
+// logQuery records rcode in h.Metrics and, if -querylog is set, appends
+// a structured entry for this query/response pair.
+func (h *handler) logQuery(client string, q dns.Question, answer []dns.RR, upstream string, rtt time.Duration, cacheHit bool, rcode int) {
+	rcodeName := dns.RcodeToString[rcode]
+	if h.Metrics != nil {
+		h.Metrics.observeRcode(rcodeName)
+	}
+	if h.QueryLog == nil {
+		return
+	}
+	entry := queryLogEntry{
+		Time:     time.Now(),
+		Client:   client,
+		Question: q.String(),
+		Upstream: upstream,
+		Rcode:    rcodeName,
+		CacheHit: cacheHit,
+	}
+	if rtt > 0 {
+		entry.RTT = rtt.String()
+	}
+	for _, rr := range answer {
+		entry.Answers = append(entry.Answers, rr.String())
+	}
+	h.QueryLog.log(entry)
 }
 
 func (h *handler) ReadDb(fname string) (err error) {
@@ -210,11 +355,13 @@ func (h *handler) ReadDb(fname string) (err error) {
 	}
 	h.ptrMap = make(map[string]string)
 	if err := h.StoreDB.View(func(txn *badger.Txn) error {
-		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(ptrKeyPrefix)
+		it := txn.NewIterator(opts)
 		defer it.Close()
-		for it.Rewind(); it.Valid(); it.Next() {
+		for it.Seek(opts.Prefix); it.ValidForPrefix(opts.Prefix); it.Next() {
 			item := it.Item()
-			k := item.Key()
+			k := bytes.TrimPrefix(item.Key(), []byte(ptrKeyPrefix))
 			err := item.Value(func(v []byte) error {
 				h.ptrMap[string(k)] = string(v)
 				if !h.IsSilent {
@@ -230,9 +377,62 @@ func (h *handler) ReadDb(fname string) (err error) {
 	}); err != nil {
 		return err
 	}
+	if len(h.ptrMap) == 0 {
+		if err := h.migrateLegacyPtrKeys(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// migrateLegacyPtrKeys rewrites PTR entries written by earlier
+// versions of this program, which stored them unprefixed instead of
+// under ptrKeyPrefix. Without this, upgrading an existing -store
+// database would load an empty ptrMap and silently orphan every
+// previously cached PTR record. Only runs when ReadDb's prefixed scan
+// came back empty, so it's a one-time no-op cost on an up-to-date db.
+func (h *handler) migrateLegacyPtrKeys() error {
+	var legacy []struct{ key, value []byte }
+	if err := h.StoreDB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			k := item.Key()
+			if bytes.HasPrefix(k, []byte(ptrKeyPrefix)) || bytes.HasPrefix(k, []byte(fwdKeyPrefix)) {
+				continue
+			}
+			kCopy := append([]byte(nil), k...)
+			err := item.Value(func(v []byte) error {
+				legacy = append(legacy, struct{ key, value []byte }{kCopy, append([]byte(nil), v...)})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if len(legacy) == 0 {
+		return nil
+	}
+	log.Printf("found %d legacy PTR entries without %q prefix, migrating", len(legacy), ptrKeyPrefix)
+	return h.StoreDB.Update(func(txn *badger.Txn) error {
+		for _, kv := range legacy {
+			h.ptrMap[string(kv.key)] = string(kv.value)
+			if err := txn.Set([]byte(ptrKeyPrefix+string(kv.key)), kv.value); err != nil {
+				return err
+			}
+			if err := txn.Delete(kv.key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 const (
 	setcapHelp    = "sudo setcap cap_net_bind_service,cap_sys_chroot=ep"
 	chrootHelp    = "-chroot ''"
@@ -255,11 +455,17 @@ func main() {
 	h := &handler{}
 
 	var upstream ArrayFlag
-	flag.Var(&upstream, "upstream", "upstream DNS server (tcp-tls:// prefix for DoT), multi-val, can prefix with .domain=")
+	flag.Var(&upstream, "upstream", "upstream DNS server (tcp-tls:// or https:// prefix for DoT/DoH), multi-val, can prefix with .domain=")
+	var blocklistFlag ArrayFlag
+	flag.Var(&blocklistFlag, "blocklist", "hosts or Adblock-format blocklist file, multi-val, reloaded on SIGHUP")
+	flag.StringVar(&h.BlockMode, "blockmode", BlockModeNXDomain,
+		"How to answer blocked queries: "+BlockModeNXDomain+", "+BlockModeZero+", or a sinkhole IP address")
 	listenAddrFlag := flag.String("listen", ":53", "listen address")
 	tlsListenFlag := flag.String("tlslisten", ":853", "TCP-TLS listener address")
-	certFlag := flag.String("cert", "", "TCP-TLS listener certificate (required for tls listener)")
-	keyFlag := flag.String("key", "", "TCP-TLS certificate key (default same as -cert value)")
+	dohListenFlag := flag.String("doh-listen", "", "DNS-over-HTTPS listener address (requires -cert)")
+	dohPathFlag := flag.String("doh-path", "/dns-query", "DNS-over-HTTPS URL path")
+	certFlag := flag.String("cert", "", "TCP-TLS/DoH listener certificate (required for tls/doh listener)")
+	keyFlag := flag.String("key", "", "TCP-TLS/DoH certificate key (default same as -cert value)")
 	debounceDelayFlag := flag.String("debounce", "200ms",
 		"Required time duration between UDP replies to single IP to prevent DoS")
 	flag.IntVar(&h.DebounceCount, "count", 100,
@@ -268,17 +474,65 @@ func main() {
 	chrootFlag := flag.String("chroot", DefaultChroot, "chroot to directory after start")
 	flag.BoolVar(&h.IsSilent, "silent", false, "Don't report normal data")
 	flag.DurationVar(&h.ClientTimeout, "ctmout", 0, "Client timeout for upstream queries")
+	flag.StringVar(&h.Strategy, "strategy", StrategyFailover,
+		"Upstream selection strategy when a domain has several upstreams: "+
+			StrategyFailover+", "+StrategyFastest+", "+StrategyParallel+" or "+StrategyRoundRobin)
+	debugListenFlag := flag.String("debug-listen", "", "Listen address for the upstream health debug endpoint")
+	metricsListenFlag := flag.String("metrics-listen", "", "Listen address for the Prometheus metrics endpoint")
+	querylogFlag := flag.String("querylog", "", "Write newline-delimited JSON query log to this file")
+	querylogMaxSizeFlag := flag.Int64("querylog-maxsize", 100*1024*1024, "Rotate -querylog once it exceeds this many bytes (0 disables rotation)")
+	cacheSizeFlag := flag.Int("cache-size", 10000, "Max forward cache entries kept in memory when -store isn't set")
+	flag.DurationVar(&h.ServeStale, "serve-stale", 0,
+		"Serve stale cached forward responses for this long past expiry when upstreams are unreachable (0 disables)")
+	ecsFlag := flag.String("ecs", ECSOff,
+		"EDNS Client Subnet forwarded upstream: "+ECSOff+", "+ECSPassthrough+", "+ECSStrip+" or synthesize=<ip>")
+	flag.IntVar(&h.ECSv4Prefix, "ecs-v4-prefix", 24, "IPv4 prefix length forwarded in the ECS option")
+	flag.IntVar(&h.ECSv6Prefix, "ecs-v6-prefix", 56, "IPv6 prefix length forwarded in the ECS option")
+	flag.BoolVar(&h.CookiesEnabled, "cookies", false, "Validate DNS Cookies (RFC 7873) from clients, rejecting bad ones with BADCOOKIE")
 	flag.Parse()
 
+	var err error
+	if h.ECSMode, h.ECSSynthesizeIP, err = parseECSMode(*ecsFlag); err != nil {
+		log.Fatalf("%s", err)
+	}
+	if err := validateStrategy(h.Strategy); err != nil {
+		log.Fatalf("%s", err)
+	}
+	if h.CookiesEnabled {
+		if _, err := rand.Read(h.cookieSecret[:]); err != nil {
+			log.Fatalf("Cannot generate DNS cookie secret: %s", err)
+		}
+	}
+
+	if *metricsListenFlag != "" {
+		h.Metrics = newQueryMetrics()
+	}
+
 	if len(upstream) == 0 {
 		upstream.Set("tcp-tls://1.1.1.1:853")
 	}
 	h.SetUpstream(upstream)
 
+	if *querylogFlag != "" {
+		var err error
+		if h.QueryLog, err = newQueryLogger(*querylogFlag, *querylogMaxSizeFlag); err != nil {
+			log.Fatalf("Cannot open query log %#v: %s", *querylogFlag, err)
+		}
+		defer h.QueryLog.Close()
+	}
+
+	if len(blocklistFlag) > 0 {
+		h.Filters = &filterState{}
+		if err := h.Filters.reload(blocklistFlag); err != nil {
+			log.Fatalf("Cannot load blocklists: %s", err)
+		}
+	}
+
 	var tlsServer *dns.Server
 	var srv *dns.Server
+	var tlsCert *tls.Certificate
 
-	if *tlsListenFlag != "" && *certFlag != "" {
+	if *certFlag != "" {
 		if *keyFlag == "" {
 			*keyFlag = *certFlag
 		}
@@ -286,11 +540,14 @@ func main() {
 		if err != nil {
 			log.Fatalf("Cannot load X509 Cert/Key from %#v/%#v: %s", *certFlag, *keyFlag, err)
 		}
+		tlsCert = &cert
+	}
 
+	if *tlsListenFlag != "" && tlsCert != nil {
 		tlsServer = &dns.Server{
 			Addr:      *tlsListenFlag,
 			Net:       "tcp-tls",
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}},
+			TLSConfig: &tls.Config{Certificates: []tls.Certificate{*tlsCert}},
 			Handler:   h,
 		}
 	}
@@ -315,6 +572,12 @@ func main() {
 		defer h.StoreDB.Close()
 	}
 
+	if h.StoreDB != nil {
+		h.Cache = &badgerForwardCache{db: h.StoreDB}
+	} else {
+		h.Cache = newLRUForwardCache(*cacheSizeFlag)
+	}
+
 	if *debounceDelayFlag != "" {
 		var err error
 		h.DebounceDelay, err = time.ParseDuration(*debounceDelayFlag)
@@ -324,7 +587,7 @@ func main() {
 	}
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 
 	if *listenAddrFlag != "" {
 		srv = &dns.Server{Addr: *listenAddrFlag, Net: "udp", Handler: h, ReusePort: true}
@@ -365,12 +628,51 @@ func main() {
 				log.Fatalf("Cannot serve TCP-TLS DNS server on %#v: %s", *tlsListenFlag, err)
 			}
 		}()
-	} else if srv == nil {
+	} else if srv == nil && *dohListenFlag == "" {
 		log.Fatalf("No DNS server listeners defined")
 	}
 
-	s := <-c
-	if !h.IsSilent {
-		log.Printf("Signal received: %s", s)
+	if *dohListenFlag != "" {
+		if tlsCert == nil {
+			log.Fatalf("-doh-listen requires -cert")
+		}
+		go func() {
+			if err := h.ListenAndServeDoH(*dohListenFlag, *dohPathFlag, *tlsCert); err != nil {
+				log.Fatalf("Cannot serve DoH on %#v: %s", *dohListenFlag, err)
+			}
+		}()
+	}
+
+	if *debugListenFlag != "" {
+		go func() {
+			log.Printf("Debug endpoint listening on %s", *debugListenFlag)
+			if err := http.ListenAndServe(*debugListenFlag, h.DebugHandler()); err != nil {
+				log.Fatalf("Cannot serve debug endpoint on %#v: %s", *debugListenFlag, err)
+			}
+		}()
+	}
+
+	if *metricsListenFlag != "" {
+		go func() {
+			log.Printf("Metrics endpoint listening on %s", *metricsListenFlag)
+			if err := http.ListenAndServe(*metricsListenFlag, h.MetricsHandler()); err != nil {
+				log.Fatalf("Cannot serve metrics endpoint on %#v: %s", *metricsListenFlag, err)
+			}
+		}()
+	}
+
+	for s := range c {
+		if !h.IsSilent {
+			log.Printf("Signal received: %s", s)
+		}
+		if s == syscall.SIGHUP && h.Filters != nil {
+			if err := h.Filters.reload(blocklistFlag); err != nil {
+				log.Printf("Cannot reload blocklists: %s", err)
+			} else {
+				log.Printf("Reloaded %d blocklist file(s)", len(blocklistFlag))
+			}
+			continue
+		}
+		break
 	}
 }
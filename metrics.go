@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rttBuckets are the upstream RTT histogram bucket boundaries, in
+// seconds, loosely matching Prometheus's own default latency buckets.
+var rttBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// rttHistogram is a cumulative Prometheus-style histogram of upstream
+// exchange round-trip times for a single upstream.
+type rttHistogram struct {
+	mu      sync.Mutex
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+func newRTTHistogram() *rttHistogram {
+	return &rttHistogram{buckets: make([]uint64, len(rttBuckets))}
+}
+
+func (h *rttHistogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.sum += seconds
+	h.count++
+	for i, le := range rttBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+		}
+	}
+}
+
+func (h *rttHistogram) snapshot() (buckets []uint64, sum float64, count uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	buckets = append(buckets[:0:0], h.buckets...)
+	return buckets, h.sum, h.count
+}
+
+// clientRateTracker turns raw per-client query counts into a
+// queries-per-second gauge, recomputed once per window.
+type clientRateTracker struct {
+	mu          sync.Mutex
+	window      time.Duration
+	windowStart time.Time
+	counts      map[string]uint64
+	rates       map[string]float64
+}
+
+func newClientRateTracker(window time.Duration) *clientRateTracker {
+	return &clientRateTracker{window: window, windowStart: time.Now(), counts: map[string]uint64{}, rates: map[string]float64{}}
+}
+
+func (c *clientRateTracker) observe(client string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elapsed := time.Since(c.windowStart); elapsed >= c.window {
+		c.rates = make(map[string]float64, len(c.counts))
+		for ip, n := range c.counts {
+			c.rates[ip] = float64(n) / elapsed.Seconds()
+		}
+		c.counts = map[string]uint64{}
+		c.windowStart = time.Now()
+	}
+	c.counts[client]++
+}
+
+func (c *clientRateTracker) snapshot() map[string]float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]float64, len(c.rates))
+	for ip, rate := range c.rates {
+		out[ip] = rate
+	}
+	return out
+}
+
+// queryMetrics accumulates the counters/histograms exposed by the
+// -metrics-listen endpoint; values that just reflect live handler state
+// (cache size gauges, the debounce drop counter) are read directly by
+// MetricsHandler.
+type queryMetrics struct {
+	mu             sync.Mutex
+	queriesByType  map[string]uint64
+	queriesByRcode map[string]uint64
+	upstreamRTT    map[string]*rttHistogram
+	clientRate     *clientRateTracker
+}
+
+func newQueryMetrics() *queryMetrics {
+	return &queryMetrics{
+		queriesByType:  map[string]uint64{},
+		queriesByRcode: map[string]uint64{},
+		upstreamRTT:    map[string]*rttHistogram{},
+		clientRate:     newClientRateTracker(time.Minute),
+	}
+}
+
+func (m *queryMetrics) observeQuery(qtype, client string) {
+	m.mu.Lock()
+	m.queriesByType[qtype]++
+	m.mu.Unlock()
+	m.clientRate.observe(client)
+}
+
+func (m *queryMetrics) observeRcode(rcode string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queriesByRcode[rcode]++
+}
+
+func (m *queryMetrics) observeUpstreamRTT(upstream string, rtt time.Duration) {
+	m.mu.Lock()
+	h, ok := m.upstreamRTT[upstream]
+	if !ok {
+		h = newRTTHistogram()
+		m.upstreamRTT[upstream] = h
+	}
+	m.mu.Unlock()
+	h.observe(rtt)
+}
+
+// escapeLabelValue quotes a Prometheus label value per the text
+// exposition format (https://prometheus.io/docs/instrumenting/exposition_formats/).
+func escapeLabelValue(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, `"`, `\"`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return v
+}
+
+func writeHelp(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// render writes every accumulated metric in Prometheus text exposition
+// format to w.
+func (m *queryMetrics) render(w io.Writer) {
+	m.mu.Lock()
+	byType := make(map[string]uint64, len(m.queriesByType))
+	for k, v := range m.queriesByType {
+		byType[k] = v
+	}
+	byRcode := make(map[string]uint64, len(m.queriesByRcode))
+	for k, v := range m.queriesByRcode {
+		byRcode[k] = v
+	}
+	hists := make(map[string]*rttHistogram, len(m.upstreamRTT))
+	upstreams := make([]string, 0, len(m.upstreamRTT))
+	for up, h := range m.upstreamRTT {
+		hists[up] = h
+		upstreams = append(upstreams, up)
+	}
+	m.mu.Unlock()
+
+	writeHelp(w, "prdnsd_queries_total", "Total DNS queries received, by question type.", "counter")
+	for _, qtype := range sortedKeys(byType) {
+		fmt.Fprintf(w, "prdnsd_queries_total{qtype=\"%s\"} %d\n", escapeLabelValue(qtype), byType[qtype])
+	}
+
+	writeHelp(w, "prdnsd_responses_total", "Total DNS responses sent, by response code.", "counter")
+	for _, rcode := range sortedKeys(byRcode) {
+		fmt.Fprintf(w, "prdnsd_responses_total{rcode=\"%s\"} %d\n", escapeLabelValue(rcode), byRcode[rcode])
+	}
+
+	writeHelp(w, "prdnsd_upstream_rtt_seconds", "Upstream exchange round-trip time in seconds.", "histogram")
+	sort.Strings(upstreams)
+	for _, up := range upstreams {
+		buckets, sum, count := hists[up].snapshot()
+		label := escapeLabelValue(up)
+		for i, le := range rttBuckets {
+			fmt.Fprintf(w, "prdnsd_upstream_rtt_seconds_bucket{upstream=\"%s\",le=\"%g\"} %d\n", label, le, buckets[i])
+		}
+		fmt.Fprintf(w, "prdnsd_upstream_rtt_seconds_bucket{upstream=\"%s\",le=\"+Inf\"} %d\n", label, count)
+		fmt.Fprintf(w, "prdnsd_upstream_rtt_seconds_sum{upstream=\"%s\"} %g\n", label, sum)
+		fmt.Fprintf(w, "prdnsd_upstream_rtt_seconds_count{upstream=\"%s\"} %d\n", label, count)
+	}
+
+	writeHelp(w, "prdnsd_client_query_rate", "Per-client queries-per-second over the last sampling window.", "gauge")
+	for client, rate := range m.clientRate.snapshot() {
+		fmt.Fprintf(w, "prdnsd_client_query_rate{client=\"%s\"} %g\n", escapeLabelValue(client), rate)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, value float64) {
+	writeHelp(w, name, help, "gauge")
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+func writeCounter(w io.Writer, name, help string, value float64) {
+	writeHelp(w, name, help, "counter")
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+// MetricsHandler exposes h.Metrics plus the live cache/debounce gauges
+// in Prometheus text exposition format for the -metrics-listen endpoint.
+func (h *handler) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if h.Metrics != nil {
+			h.Metrics.render(w)
+		}
+
+		h.ptrMapLock.Lock()
+		ptrEntries := len(h.ptrMap)
+		h.ptrMapLock.Unlock()
+		writeGauge(w, "prdnsd_ptr_cache_entries", "Number of cached PTR entries.", float64(ptrEntries))
+
+		if h.StoreDB != nil {
+			lsm, vlog := h.StoreDB.Size()
+			writeGauge(w, "prdnsd_badger_lsm_bytes", "Badger LSM tree size in bytes.", float64(lsm))
+			writeGauge(w, "prdnsd_badger_vlog_bytes", "Badger value log size in bytes.", float64(vlog))
+		}
+
+		writeCounter(w, "prdnsd_debounce_drops_total", "Queries dropped by the per-client debounce DoS check.", float64(atomic.LoadUint64(&h.DebounceDrops)))
+	})
+}
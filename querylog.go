@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// queryLogEntry is one newline-delimited JSON record written by
+// -querylog, modeled after what AdGuard-style query logs expose.
+type queryLogEntry struct {
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Question string    `json:"question"`
+	Answers  []string  `json:"answers,omitempty"`
+	RTT      string    `json:"rtt,omitempty"`
+	Upstream string    `json:"upstream,omitempty"`
+	Rcode    string    `json:"rcode"`
+	CacheHit bool      `json:"cache_hit"`
+}
+
+// queryLogger appends newline-delimited JSON query log entries to path,
+// rotating the file to path+".1" before a write would push it past
+// maxBytes.
+type queryLogger struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	f        *os.File
+	size     int64
+}
+
+// newQueryLogger opens (creating if necessary) the query log at path.
+// maxBytes <= 0 disables rotation.
+func newQueryLogger(path string, maxBytes int64) (*queryLogger, error) {
+	ql := &queryLogger{path: path, maxBytes: maxBytes}
+	if err := ql.open(); err != nil {
+		return nil, err
+	}
+	return ql, nil
+}
+
+func (ql *queryLogger) open() error {
+	f, err := os.OpenFile(ql.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	ql.f = f
+	ql.size = fi.Size()
+	return nil
+}
+
+func (ql *queryLogger) rotate() error {
+	if err := ql.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(ql.path, ql.path+".1"); err != nil {
+		return err
+	}
+	return ql.open()
+}
+
+// log appends entry as a single JSON line, rotating first if that would
+// push the file past maxBytes.
+func (ql *queryLogger) log(entry queryLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Cannot marshal query log entry: %s", err)
+		return
+	}
+	line = append(line, '\n')
+
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	if ql.maxBytes > 0 && ql.size+int64(len(line)) > ql.maxBytes {
+		if err := ql.rotate(); err != nil {
+			log.Printf("Cannot rotate query log %#v: %s", ql.path, err)
+		}
+	}
+	n, err := ql.f.Write(line)
+	if err != nil {
+		log.Printf("Cannot write to query log %#v: %s", ql.path, err)
+		return
+	}
+	ql.size += int64(n)
+}
+
+func (ql *queryLogger) Close() error {
+	ql.mu.Lock()
+	defer ql.mu.Unlock()
+	return ql.f.Close()
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Strategy names accepted by the -strategy flag.
+const (
+	StrategyFailover   = "failover"
+	StrategyFastest    = "fastest"
+	StrategyParallel   = "parallel"
+	StrategyRoundRobin = "round-robin"
+)
+
+// validateStrategy rejects anything the -strategy flag doesn't recognize,
+// so a typo fails fast at startup instead of silently behaving as
+// StrategyFailover.
+func validateStrategy(strategy string) error {
+	switch strategy {
+	case StrategyFailover, StrategyFastest, StrategyParallel, StrategyRoundRobin:
+		return nil
+	default:
+		return fmt.Errorf("unrecognized -strategy %q, want one of %s, %s, %s or %s",
+			strategy, StrategyFailover, StrategyFastest, StrategyParallel, StrategyRoundRobin)
+	}
+}
+
+const (
+	ewmaAlpha       = 0.3
+	maxConsecErrors = 3
+	cooldownWindow  = 30 * time.Second
+)
+
+// Upstream is a single configured resolver PR-DNSd can forward queries to.
+type Upstream interface {
+	Exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, time.Duration, error)
+	String() string
+}
+
+// dnsUpstream forwards over plain UDP, TCP or TCP-TLS using *dns.Client.
+type dnsUpstream struct {
+	client *dns.Client
+	addr   string
+}
+
+// Exchange dials its own connection (rather than using Client.ExchangeContext,
+// which only consults ctx for read/write deadlines and never actually stops a
+// blocking read) and closes it as soon as ctx is done, so a raceExchange
+// loser's in-flight UDP/TCP read is interrupted immediately instead of
+// running until its own dnsTimeout/ClientTimeout elapses.
+func (u *dnsUpstream) Exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	conn, err := u.client.DialContext(ctx, u.addr)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	return u.client.ExchangeWithConnContext(ctx, r, conn)
+}
+
+func (u *dnsUpstream) String() string { return u.client.Net + "://" + u.addr }
+
+// httpsUpstream forwards queries as RFC 8484 DNS-over-HTTPS POST requests.
+type httpsUpstream struct {
+	url    string
+	client *http.Client
+}
+
+func (u *httpsUpstream) Exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, time.Duration, error) {
+	packed, err := r.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(packed))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", dohMediaType)
+	start := time.Now()
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, time.Since(start), err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	rtt := time.Since(start)
+	if err != nil {
+		return nil, rtt, err
+	}
+	respMsg := &dns.Msg{}
+	if err := respMsg.Unpack(body); err != nil {
+		return nil, rtt, err
+	}
+	return respMsg, rtt, nil
+}
+
+func (u *httpsUpstream) String() string { return u.url }
+
+// upstreamStats tracks the rolling health of a trackedUpstream so the
+// failover strategy can demote resolvers that keep erroring. ewmaRTT is
+// only reported by the debug endpoint; it does not affect ordering.
+type upstreamStats struct {
+	ewmaRTT       time.Duration
+	consecErrors  int
+	cooldownUntil time.Time
+}
+
+// trackedUpstream wraps an Upstream with the bookkeeping needed by the
+// strategy layer, the debug endpoint and -metrics-listen.
+type trackedUpstream struct {
+	Upstream
+	mu      sync.Mutex
+	stats   upstreamStats
+	metrics *queryMetrics
+}
+
+// exchange runs the query against the wrapped Upstream, updating health
+// stats and (if set) the upstream RTT histogram, and reports its own
+// String() back to the caller so it can be attributed in logs/metrics.
+func (t *trackedUpstream) exchange(ctx context.Context, r *dns.Msg) (*dns.Msg, time.Duration, string, error) {
+	resp, rtt, err := t.Upstream.Exchange(ctx, r)
+	t.record(resp, rtt, err)
+	if t.metrics != nil {
+		t.metrics.observeUpstreamRTT(t.String(), rtt)
+	}
+	return resp, rtt, t.String(), err
+}
+
+func (t *trackedUpstream) record(resp *dns.Msg, rtt time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err != nil || (resp != nil && resp.Rcode == dns.RcodeServerFailure) {
+		t.stats.consecErrors++
+		if t.stats.consecErrors >= maxConsecErrors {
+			t.stats.cooldownUntil = time.Now().Add(cooldownWindow)
+		}
+		return
+	}
+	t.stats.consecErrors = 0
+	if t.stats.ewmaRTT == 0 {
+		t.stats.ewmaRTT = rtt
+	} else {
+		t.stats.ewmaRTT = time.Duration(float64(t.stats.ewmaRTT)*(1-ewmaAlpha) + float64(rtt)*ewmaAlpha)
+	}
+}
+
+func (t *trackedUpstream) healthy() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return time.Now().After(t.stats.cooldownUntil)
+}
+
+func (t *trackedUpstream) snapshot() upstreamStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// domainRoute is everything routed to a single domain suffix: the set of
+// candidate upstreams and the round-robin cursor shared between queries.
+// matchesApex records whether the configured domain itself (not just its
+// subdomains) should resolve through this route: true for the default
+// ("") route and for a bare, non-dot-prefixed domain spec; false for the
+// documented ".domain=" form, which only ever matched subdomains under
+// the original strings.Index-based lookup.
+type domainRoute struct {
+	upstreams   []*trackedUpstream
+	rrCursor    uint32
+	matchesApex bool
+}
+
+// domainTrie does longest-suffix matching of a query name against the
+// configured domains in O(labels) instead of the previous O(labels^2)
+// strings.Index loop.
+type domainTrie struct {
+	children map[string]*domainTrie
+	route    *domainRoute
+}
+
+func newDomainTrie() *domainTrie {
+	return &domainTrie{children: map[string]*domainTrie{}}
+}
+
+// labels splits a domain into its parts, most significant (TLD) first,
+// ignoring any leading "." used by the -upstream flag convention.
+func labels(domain string) []string {
+	domain = strings.TrimPrefix(domain, ".")
+	if domain == "" {
+		return nil
+	}
+	parts := strings.Split(domain, ".")
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return parts
+}
+
+func (t *domainTrie) add(domain string, up *trackedUpstream) {
+	matchesApex := domain == "" || !strings.HasPrefix(domain, ".")
+	node := t
+	for _, label := range labels(domain) {
+		child, ok := node.children[label]
+		if !ok {
+			child = newDomainTrie()
+			node.children[label] = child
+		}
+		node = child
+	}
+	if node.route == nil {
+		node.route = &domainRoute{matchesApex: matchesApex}
+	}
+	node.route.upstreams = append(node.route.upstreams, up)
+}
+
+// lookup returns the route for the longest configured suffix of qName,
+// falling back to the default ("") route if nothing more specific matches.
+// A ".domain=" route only matches proper subdomains of domain, never
+// qName being domain itself, matching the historical strings.Index-based
+// lookup this trie replaced.
+func (t *domainTrie) lookup(qName string) *domainRoute {
+	node := t
+	best := t.route
+	qLabels := labels(qName)
+	for i, label := range qLabels {
+		child, ok := node.children[label]
+		if !ok {
+			break
+		}
+		node = child
+		if node.route != nil {
+			atApex := i == len(qLabels)-1
+			if node.route.matchesApex || !atApex {
+				best = node.route
+			}
+		}
+	}
+	return best
+}
+
+// all walks the trie, used by the debug endpoint to dump every upstream.
+func (t *domainTrie) all(into map[*trackedUpstream]bool) {
+	if t.route != nil {
+		for _, u := range t.route.upstreams {
+			into[u] = true
+		}
+	}
+	for _, child := range t.children {
+		child.all(into)
+	}
+}
+
+// exchangeStrategy dispatches r to route's upstreams according to
+// strategy, returning the first acceptable response along with the
+// String() of the upstream that produced it.
+func exchangeStrategy(ctx context.Context, strategy string, route *domainRoute, r *dns.Msg) (*dns.Msg, time.Duration, string, error) {
+	if route == nil || len(route.upstreams) == 0 {
+		return nil, 0, "", errNoUpstream(errNoUpstreamErr)
+	}
+	switch strategy {
+	case StrategyFastest, StrategyParallel:
+		return raceExchange(ctx, route.upstreams, r)
+	case StrategyRoundRobin:
+		idx := atomic.AddUint32(&route.rrCursor, 1) - 1
+		u := route.upstreams[int(idx)%len(route.upstreams)]
+		return u.exchange(ctx, r)
+	default:
+		return failoverExchange(ctx, route.upstreams, r)
+	}
+}
+
+// raceExchange dispatches r to every upstream concurrently and returns
+// the first non-error, non-SERVFAIL response, cancelling the rest.
+func raceExchange(ctx context.Context, upstreams []*trackedUpstream, r *dns.Msg) (*dns.Msg, time.Duration, string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		resp     *dns.Msg
+		rtt      time.Duration
+		upstream string
+		err      error
+	}
+	results := make(chan result, len(upstreams))
+	for _, u := range upstreams {
+		u := u
+		go func() {
+			resp, rtt, upstream, err := u.exchange(ctx, r)
+			results <- result{resp, rtt, upstream, err}
+		}()
+	}
+
+	var lastErr error
+	var lastRTT time.Duration
+	for range upstreams {
+		res := <-results
+		if res.err == nil && res.resp != nil && res.resp.Rcode != dns.RcodeServerFailure {
+			return res.resp, res.rtt, res.upstream, nil
+		}
+		lastErr, lastRTT = res.err, res.rtt
+	}
+	if lastErr == nil {
+		lastErr = errNoUpstreamErr
+	}
+	return nil, lastRTT, "", lastErr
+}
+
+// failoverExchange tries upstreams in order, preferring healthy ones,
+// and returns the first successful response.
+func failoverExchange(ctx context.Context, upstreams []*trackedUpstream, r *dns.Msg) (*dns.Msg, time.Duration, string, error) {
+	ordered := make([]*trackedUpstream, 0, len(upstreams))
+	var unhealthy []*trackedUpstream
+	for _, u := range upstreams {
+		if u.healthy() {
+			ordered = append(ordered, u)
+		} else {
+			unhealthy = append(unhealthy, u)
+		}
+	}
+	ordered = append(ordered, unhealthy...)
+
+	var lastErr error
+	var lastRTT time.Duration
+	for _, u := range ordered {
+		resp, rtt, upstream, err := u.exchange(ctx, r)
+		if err == nil && resp != nil && resp.Rcode != dns.RcodeServerFailure {
+			return resp, rtt, upstream, nil
+		}
+		lastErr, lastRTT = err, rtt
+		if err == nil {
+			lastErr = errNoUpstreamErr
+		}
+	}
+	return nil, lastRTT, "", lastErr
+}
+
+// DebugHandler exposes per-upstream health stats for troubleshooting,
+// meant to be mounted on an operator-only listener.
+func (h *handler) DebugHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		seen := map[*trackedUpstream]bool{}
+		if h.routes != nil {
+			h.routes.all(seen)
+		}
+		type upstreamDebug struct {
+			Upstream      string `json:"upstream"`
+			EWMARTT       string `json:"ewma_rtt"`
+			ConsecErrors  int    `json:"consec_errors"`
+			CooldownUntil string `json:"cooldown_until,omitempty"`
+		}
+		out := make([]upstreamDebug, 0, len(seen))
+		for u := range seen {
+			stats := u.snapshot()
+			d := upstreamDebug{Upstream: u.String(), EWMARTT: stats.ewmaRTT.String(), ConsecErrors: stats.consecErrors}
+			if stats.cooldownUntil.After(time.Now()) {
+				d.CooldownUntil = stats.cooldownUntil.Format(time.RFC3339)
+			}
+			out = append(out, d)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			log.Printf("Cannot write debug response: %s", err)
+		}
+	})
+}
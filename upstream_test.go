@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func stubUpstream(addr string) *trackedUpstream {
+	return &trackedUpstream{Upstream: &dnsUpstream{client: &dns.Client{Net: "udp"}, addr: addr}}
+}
+
+func TestDomainTrieLongestSuffixWins(t *testing.T) {
+	trie := newDomainTrie()
+	trie.add("", stubUpstream("default:53"))
+	trie.add(".example.com", stubUpstream("example:53"))
+	trie.add(".www.example.com", stubUpstream("wwwexample:53"))
+
+	cases := []struct {
+		qName string
+		addr  string
+	}{
+		{"other.org", "default:53"},
+		{"sub.example.com", "example:53"},
+		// www.example.com is the apex of the .www.example.com route, so
+		// that route doesn't apply here; falls back to .example.com.
+		{"www.example.com", "example:53"},
+		{"deep.www.example.com", "wwwexample:53"},
+	}
+	for _, c := range cases {
+		route := trie.lookup(c.qName)
+		if route == nil || len(route.upstreams) != 1 || route.upstreams[0].String() != "udp://"+c.addr {
+			t.Errorf("lookup(%q) = %v, want %s", c.qName, route, c.addr)
+		}
+	}
+}
+
+func TestDomainTrieApexExclusion(t *testing.T) {
+	trie := newDomainTrie()
+	trie.add(".example.com", stubUpstream("sub:53"))
+
+	if route := trie.lookup("example.com"); route != nil {
+		t.Errorf("lookup(%q) = %v, want nil: a .domain= route must not match the bare apex", "example.com", route)
+	}
+	if route := trie.lookup("www.example.com"); route == nil {
+		t.Errorf("lookup(%q) = nil, want the .example.com route", "www.example.com")
+	}
+}
+
+func TestDomainTrieBareDomainMatchesApex(t *testing.T) {
+	trie := newDomainTrie()
+	trie.add("example.com", stubUpstream("bare:53"))
+
+	if route := trie.lookup("example.com"); route == nil {
+		t.Errorf("lookup(%q) = nil, want a bare domain spec to match its own apex", "example.com")
+	}
+}